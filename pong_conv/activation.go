@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+
+	"github.com/unixpickle/anynet"
+)
+
+// DefaultActivation is the nonlinearity used throughout the
+// conv layers, the FC head, and the vanilla RNN. It is Tanh,
+// but can be overridden with the ACTIVATION=relu
+// environment variable so the same TRPO code can be trained
+// with either activation.
+const DefaultActivation = "tanh"
+
+// activationName returns the configured activation, either
+// "tanh" or "relu".
+func activationName() string {
+	switch os.Getenv("ACTIVATION") {
+	case "relu":
+		return "relu"
+	case "tanh":
+		return "tanh"
+	default:
+		return DefaultActivation
+	}
+}
+
+// activationMarkup is the keyword activationName() maps to in
+// the anyconv markup language used by loadOrCreateNetwork.
+func activationMarkup() string {
+	if activationName() == "relu" {
+		return "ReLU"
+	}
+	return "Tanh"
+}
+
+// vanillaActivation is the activation passed to
+// anyrnn.NewVanilla.
+func vanillaActivation() anynet.Layer {
+	if activationName() == "relu" {
+		return anynet.ReLU
+	}
+	return anynet.Tanh
+}
+
+// linearScale picks the weight-init scale for the Linear
+// prelude layer. ReLU uses a larger, He-style scale since its
+// gradients vanish for negative pre-activations, where Tanh
+// prefers the smaller scale the network already used.
+func linearScale() float64 {
+	if activationName() == "relu" {
+		return 0.1
+	}
+	return 0.01
+}
+
+// useBiasBoost reports whether setupVisionLayers should nudge
+// biases positive via boostBiases. This only matters for
+// ReLU, where units initialized with a negative bias never
+// activate; Tanh has no such failure mode.
+func useBiasBoost() bool {
+	return activationName() == "relu"
+}
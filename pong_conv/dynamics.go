@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet"
+	"github.com/unixpickle/anynet/anyconv"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyrl"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/lazyseq"
+)
+
+const (
+	// UseDynamicsModel enables model-based rollout
+	// augmentation: a learned forward-dynamics model is
+	// fit to real rollouts and used to imagine additional
+	// experience for TRPO. Off by default, like the other
+	// subsystems added alongside it.
+	UseDynamicsModel = false
+
+	DynamicsSaveFile = "trained_dynamics"
+
+	// ImaginedSteps caps how far an ImaginedRoller unrolls
+	// the policy against the dynamics model, regardless of
+	// predicted done.
+	ImaginedSteps = 200
+
+	// DoneThreshold is the predicted done probability above
+	// which an imagined episode is ended early.
+	DoneThreshold = 0.5
+
+	// ImaginedFrac sets how many imagined episodes are mixed
+	// into each TRPO batch: ImaginedFrac of them for every
+	// real RolloutSet gathered for that batch.
+	ImaginedFrac = 0.5
+
+	// UncertaintyThreshold bounds how wrong the dynamics
+	// model was allowed to have been on the real transition
+	// leaving a state before that state is off-limits for
+	// imagination.
+	UncertaintyThreshold = 0.05
+
+	dynamicsActions = 6
+)
+
+// dynamicsOutSize is the width of the model's output: the
+// next preprocessed frame, followed by a reward scalar and a
+// done logit.
+const dynamicsOutSize = 80*105*2 + 2
+
+// A DynamicsModel predicts the next preprocessed frame,
+// reward, and done flag given the current frame stack and a
+// one-hot action. anyconv has no deconvolution layer, so the
+// decoder half is a plain FC stack off the conv encoder's
+// bottleneck rather than a literal deconv net. Net is the
+// same stack wrapped as an anyrnn.Block so it can be driven
+// with the Step API used by the policy, even though it is
+// used statelessly.
+type DynamicsModel struct {
+	anyrnn.Block
+	Net anynet.Net
+}
+
+// NewDynamicsModel creates a randomly initialized
+// DynamicsModel for Pong frames preprocessed down to
+// PreprocessedSize pixels.
+func NewDynamicsModel(creator anyvec.Creator) *DynamicsModel {
+	markup := fmt.Sprintf(`
+		Input(w=80, h=105, d=2)
+
+		Linear(scale=0.01)
+
+		Conv(w=4, h=4, n=16, sx=2, sy=2)
+		Tanh
+		Conv(w=4, h=4, n=32, sx=2, sy=2)
+		Tanh
+		FC(out=512)
+		Tanh
+		FC(out=%d)
+	`, dynamicsOutSize)
+	convNet, err := anyconv.FromMarkup(creator, markup)
+	must(err)
+	net := convNet.(anynet.Net)
+
+	return &DynamicsModel{Block: &anyrnn.LayerBlock{Layer: net}, Net: net}
+}
+
+// Predict runs the dynamics model on a single (observation,
+// action) pair, returning the predicted next observation,
+// reward, and done probability.
+func (d *DynamicsModel) Predict(obs, action anyvec.Vector) (nextObs anyvec.Vector, reward,
+	done float64) {
+	in := obs.Creator().Concat(obs, action)
+	state := d.Start(1)
+	out := d.Step(state, in).Output()
+	n := out.Len()
+	nextObs = out.Slice(0, n-2)
+	tail := out.Slice(n-2, n).Data().([]float32)
+	return nextObs, float64(tail[0]), sigmoid(float64(tail[1]))
+}
+
+// PredictionError measures the L2 norm of the pixel error
+// between the model's prediction for (obsIn, action) and the
+// real next observation obsOut, divided by the number of
+// pixels. ImaginedRoller uses this to
+// decide which states are safe to imagine from.
+func (d *DynamicsModel) PredictionError(obsIn, action, obsOut anyvec.Vector) float64 {
+	pred, _, _ := d.Predict(obsIn, action)
+	diff := pred.Copy()
+	diff.Sub(obsOut)
+	return anyvec.Norm(diff).(float64) / float64(diff.Len())
+}
+
+func sigmoid(x float64) float64 {
+	return 1 / (1 + math.Exp(-x))
+}
+
+// A transition is one (obs, action) -> (obs', reward, done)
+// tuple pulled from a real RolloutSet.
+type transition struct {
+	Obs     anyvec.Vector
+	Action  anyvec.Vector
+	NextObs anyvec.Vector
+	Reward  float64
+	Done    bool
+}
+
+// A DynamicsTrainer fits a DynamicsModel to real rollouts
+// via SGD over (obs, action) -> (obs', reward, done)
+// tuples drawn from a RolloutSet.
+type DynamicsTrainer struct {
+	Model     *DynamicsModel
+	Params    []*anydiff.Var
+	StepSize  float64
+	BatchSize int
+}
+
+// NewDynamicsTrainer builds a trainer for model using the
+// repo's standard SGD step size.
+func NewDynamicsTrainer(model *DynamicsModel) *DynamicsTrainer {
+	return &DynamicsTrainer{
+		Model:     model,
+		Params:    anynet.AllParameters(model.Net),
+		StepSize:  0.001,
+		BatchSize: 256,
+	}
+}
+
+// Train runs one epoch of SGD over every transition found
+// in r.
+func (d *DynamicsTrainer) Train(r *anyrl.RolloutSet) {
+	transitions := extractTransitions(r)
+	rand.Shuffle(len(transitions), func(i, j int) {
+		transitions[i], transitions[j] = transitions[j], transitions[i]
+	})
+	for i := 0; i < len(transitions); i += d.BatchSize {
+		end := i + d.BatchSize
+		if end > len(transitions) {
+			end = len(transitions)
+		}
+		d.step(transitions[i:end])
+	}
+}
+
+// step performs one gradient update of the dynamics model
+// on a mini-batch of transitions, minimizing squared error
+// on the predicted frame plus reward/done, and applies the
+// result to the model's parameters.
+func (d *DynamicsTrainer) step(batch []transition) {
+	var total anydiff.Res
+	for i, t := range batch {
+		in := t.Obs.Creator().Concat(t.Obs, t.Action)
+		out := d.Model.Net.Apply(anydiff.NewConst(in), 1)
+		// The last output is a done logit; squash it so it is
+		// compared against the 0/1 done flag as a probability.
+		n := out.Output().Len()
+		out = anydiff.Concat(anydiff.Slice(out, 0, n-1),
+			anydiff.Sigmoid(anydiff.Slice(out, n-1, n)))
+		target := t.NextObs.Creator().Concat(t.NextObs,
+			targetTail(t.NextObs.Creator(), t.Reward, t.Done))
+		diff := anydiff.Sub(out, anydiff.NewConst(target))
+		loss := anydiff.Dot(diff, diff)
+		if i == 0 {
+			total = loss
+		} else {
+			total = anydiff.Add(total, loss)
+		}
+	}
+	grad := anydiff.NewGrad(d.Params...)
+	total.Propagate(total.Output().Creator().MakeVector(1), grad)
+	for _, p := range d.Params {
+		scaled := grad[p].Copy()
+		scaled.Scale(scaled.Creator().MakeNumeric(-d.StepSize))
+		p.Vector.Add(scaled)
+	}
+}
+
+// targetTail builds the two-element (reward, done) tail that
+// the model's output is compared against; done is 1 on an
+// episode's final transition and 0 otherwise.
+func targetTail(c anyvec.Creator, reward float64, done bool) anyvec.Vector {
+	data := []float64{reward, 0}
+	if done {
+		data[1] = 1
+	}
+	return c.MakeVectorData(c.MakeNumericList(data))
+}
+
+// extractTransitions walks the real (obs, action, reward)
+// tapes recorded by anyrl.RNNRoller and turns them into the
+// flat (obs, action) -> (obs', reward, done) tuples the
+// dynamics model is trained on.
+func extractTransitions(r *anyrl.RolloutSet) []transition {
+	var out []transition
+	obsSeqs := readTapeSequences(r.Inputs)
+	actionSeqs := readTapeSequences(r.Actions)
+	for i, ep := range r.Rewards {
+		obsSeq := obsSeqs[i]
+		actionSeq := actionSeqs[i]
+		for t := 0; t < len(ep)-1; t++ {
+			out = append(out, transition{
+				Obs:     obsSeq[t],
+				Action:  actionSeq[t],
+				NextObs: obsSeq[t+1],
+				Reward:  ep[t],
+				Done:    t == len(ep)-2,
+			})
+		}
+	}
+	return out
+}
+
+// readTapeSequences reads every per-timestep vector out of a
+// lazyseq.Tape, grouped back into one slice per episode.
+// anyseq.Batch.Packed concatenates every present sequence's
+// vector for that timestep into one backing vector, so
+// anyseq.SeparateSeqs (rather than treating Packed itself as
+// per-sequence) is what actually splits them back apart.
+func readTapeSequences(tape lazyseq.Tape) [][]anyvec.Vector {
+	var batches []*anyseq.Batch
+	for batch := range tape.ReadTape(0, -1) {
+		batches = append(batches, batch)
+	}
+	return anyseq.SeparateSeqs(batches)
+}
+
+// An ImaginedRoller produces synthetic RolloutSets by
+// unrolling the policy against a learned DynamicsModel, K
+// steps at a time, starting from real states sampled
+// uniformly across recent episodes.
+type ImaginedRoller struct {
+	Policy      anyrnn.Block
+	ActionSpace anyrl.Softmax
+	Model       *DynamicsModel
+
+	// starts holds candidate starting observations together
+	// with the model's real-world prediction error leaving
+	// them, so uncertain states can be skipped.
+	starts []imaginedStart
+}
+
+type imaginedStart struct {
+	Obs   anyvec.Vector
+	Error float64
+}
+
+// AddStart records a real (obs, action, next obs) triple as
+// a candidate for future imagination.
+func (r *ImaginedRoller) AddStart(obs, action, nextObs anyvec.Vector) {
+	err := r.Model.PredictionError(obs, action, nextObs)
+	r.starts = append(r.starts, imaginedStart{Obs: obs, Error: err})
+	// Only keep a bounded window of recent states.
+	if len(r.starts) > 10000 {
+		r.starts = r.starts[len(r.starts)-10000:]
+	}
+}
+
+// Rollout imagines n episodes of up to ImaginedSteps steps
+// each, refusing to start from states whose real prediction
+// error exceeded UncertaintyThreshold.
+func (r *ImaginedRoller) Rollout(n int) *anyrl.RolloutSet {
+	var candidates []imaginedStart
+	for _, s := range r.starts {
+		if s.Error <= UncertaintyThreshold {
+			candidates = append(candidates, s)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var sets []*anyrl.RolloutSet
+	for i := 0; i < n; i++ {
+		start := candidates[rand.Intn(len(candidates))]
+		if set := r.imagineOne(start.Obs); set != nil {
+			sets = append(sets, set)
+		}
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+	return anyrl.PackRolloutSets(sets[0].Creator(), sets)
+}
+
+// imagineOne unrolls the policy against the dynamics model
+// for up to ImaginedSteps steps from a single state,
+// recording the resulting sequence as a one-episode
+// RolloutSet. The dynamics model is only ever evaluated
+// (never trained) here, so its statistics stay frozen
+// during imagination.
+func (r *ImaginedRoller) imagineOne(start anyvec.Vector) *anyrl.RolloutSet {
+	creator := start.Creator()
+	inTape, inCh := lazyseq.ReferenceTape(creator)
+	outTape, outCh := lazyseq.ReferenceTape(creator)
+	actionTape, actionCh := lazyseq.ReferenceTape(creator)
+
+	obs := start
+	policyState := r.Policy.Start(1)
+	var rewards []float64
+	for t := 0; t < ImaginedSteps; t++ {
+		inCh <- &anyseq.Batch{Present: []bool{true}, Packed: obs}
+
+		out := r.Policy.Step(policyState, obs)
+		policyState = out.State()
+		outCh <- &anyseq.Batch{Present: []bool{true}, Packed: out.Output()}
+
+		action := r.ActionSpace.Sample(out.Output(), 1)
+		actionCh <- &anyseq.Batch{Present: []bool{true}, Packed: action}
+
+		nextObs, reward, doneProb := r.Model.Predict(obs, action)
+		rewards = append(rewards, reward)
+		if doneProb > DoneThreshold {
+			break
+		}
+		obs = nextObs
+	}
+	close(inCh)
+	close(outCh)
+	close(actionCh)
+
+	if len(rewards) == 0 {
+		return nil
+	}
+	return &anyrl.RolloutSet{
+		Inputs:    inTape,
+		AgentOuts: outTape,
+		Actions:   actionTape,
+		Rewards:   anyrl.Rewards{rewards},
+	}
+}
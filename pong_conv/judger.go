@@ -0,0 +1,298 @@
+package main
+
+import (
+	"math"
+	"os"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anynet"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyrl"
+	"github.com/unixpickle/anyvec"
+)
+
+// ActionJudgerKind selects which anypg.NaturalPG.ActionJudger
+// this main uses, overridable with the ACTION_JUDGER
+// environment variable ("q", "gae", or "vtrace"). It defaults
+// to the plain discounted-reward QJudger.
+func ActionJudgerKind() string {
+	switch os.Getenv("ACTION_JUDGER") {
+	case "gae":
+		return "gae"
+	case "vtrace":
+		return "vtrace"
+	default:
+		return "q"
+	}
+}
+
+// GAEDiscount and GAELambda are the discount and trace-decay
+// factors used by GAEJudger.
+const (
+	GAEDiscount = 0.99
+	GAELambda   = 0.95
+)
+
+// ValueNetSaveFile stores the value head's own parameters.
+// The shared body is restored from NetworkSaveFile along with
+// the rest of the policy, so only the head needs its own file.
+const ValueNetSaveFile = "trained_value_head"
+
+// VTraceRhoClip and VTraceCClip bound the importance-sampling
+// ratios used by VTraceJudger, matching the clipping used by
+// the original V-trace algorithm.
+const (
+	VTraceRhoClip = 1.0
+	VTraceCClip   = 1.0
+)
+
+// A ValueFunc estimates the discounted return from a state,
+// used by GAEJudger and VTraceJudger in place of the raw
+// Monte-Carlo return QJudger relies on.
+type ValueFunc interface {
+	// Values returns one value estimate per timestep in obs.
+	Values(obs []anyvec.Vector) []float64
+}
+
+// A ValueNet is the value head trained alongside the policy:
+// it shares the policy's conv+RNN body (the same 128-wide
+// hidden representation loadOrCreateNetwork already computes)
+// and adds its own small FC head mapping that hidden state to
+// a scalar value estimate.
+type ValueNet struct {
+	Body anyrnn.Block
+	Head *anynet.FC
+}
+
+// NewValueNet builds a randomly initialized value head for a
+// body that outputs 128-wide hidden states.
+func NewValueNet(creator anyvec.Creator, body anyrnn.Block) *ValueNet {
+	return &ValueNet{
+		Body: body,
+		Head: anynet.NewFCZero(creator, 128, 1),
+	}
+}
+
+// Values implements ValueFunc by running obs through the
+// shared body and then the value head, one timestep at a
+// time.
+func (v *ValueNet) Values(obs []anyvec.Vector) []float64 {
+	state := v.Body.Start(1)
+	out := make([]float64, len(obs))
+	for i, o := range obs {
+		res := v.Body.Step(state, o)
+		state = res.State()
+		head := v.Head.Apply(anydiff.NewConst(res.Output()), 1)
+		out[i] = float64(head.Output().Data().([]float32)[0])
+	}
+	return out
+}
+
+// A ValueTrainer fits a ValueNet to the discounted
+// Monte-Carlo return of each timestep in the rollouts it is
+// given via MSE, the auxiliary loss that keeps GAEJudger's and
+// VTraceJudger's bootstrapped value estimates well-calibrated.
+//
+// Only the head is fitted. The body's outputs enter the loss
+// as constants, so the gradient for the body's parameters is
+// zero and the BodyStepSize step leaves the body unchanged;
+// the shared body is moved only by TRPO's update on the policy.
+type ValueTrainer struct {
+	Net          *ValueNet
+	Discount     float64
+	StepSize     float64
+	BodyStepSize float64
+}
+
+// NewValueTrainer builds a trainer for net using GAEDiscount
+// and the repo's standard SGD step size.
+func NewValueTrainer(net *ValueNet) *ValueTrainer {
+	return &ValueTrainer{
+		Net:          net,
+		Discount:     GAEDiscount,
+		StepSize:     0.001,
+		BodyStepSize: 0.0001,
+	}
+}
+
+// Train performs one epoch of SGD over every episode in r.
+func (t *ValueTrainer) Train(r *anyrl.RolloutSet) {
+	obsSeqs := readTapeSequences(r.Inputs)
+	headParams := anynet.AllParameters(t.Net.Head)
+	bodyParams := anynet.AllParameters(t.Net.Body)
+	allParams := append(append([]*anydiff.Var{}, headParams...), bodyParams...)
+
+	for i, ep := range r.Rewards {
+		returns := discountedReturns(ep, t.Discount)
+
+		state := t.Net.Body.Start(1)
+		var total anydiff.Res
+		for j, obs := range obsSeqs[i] {
+			bodyOut := t.Net.Body.Step(state, obs)
+			state = bodyOut.State()
+			value := t.Net.Head.Apply(anydiff.NewConst(bodyOut.Output()), 1)
+			target := anydiff.NewConst(obs.Creator().MakeVectorData(
+				obs.Creator().MakeNumericList([]float64{returns[j]})))
+			diff := anydiff.Sub(value, target)
+			loss := anydiff.Dot(diff, diff)
+			if total == nil {
+				total = loss
+			} else {
+				total = anydiff.Add(total, loss)
+			}
+		}
+
+		grad := anydiff.NewGrad(allParams...)
+		total.Propagate(total.Output().Creator().MakeVector(1), grad)
+		for _, p := range headParams {
+			applyStep(p, grad[p], t.StepSize)
+		}
+		for _, p := range bodyParams {
+			applyStep(p, grad[p], t.BodyStepSize)
+		}
+	}
+}
+
+// applyStep applies one SGD step to p in the direction that
+// minimizes the loss grad was computed from.
+func applyStep(p *anydiff.Var, grad anyvec.Vector, stepSize float64) {
+	scaled := grad.Copy()
+	scaled.Scale(scaled.Creator().MakeNumeric(-stepSize))
+	p.Vector.Add(scaled)
+}
+
+// discountedReturns computes the to-go discounted return at
+// every timestep of a single episode's rewards.
+func discountedReturns(rewards []float64, discount float64) []float64 {
+	out := make([]float64, len(rewards))
+	var acc float64
+	for t := len(rewards) - 1; t >= 0; t-- {
+		acc = rewards[t] + discount*acc
+		out[t] = acc
+	}
+	return out
+}
+
+// A GAEJudger computes advantages with Generalized Advantage
+// Estimation:
+//
+//	delta_t = r_t + gamma*V(s_{t+1}) - V(s_t)
+//	A_t     = sum_{l>=0} (gamma*lambda)^l * delta_{t+l}
+//
+// truncated at each episode's end, using ValueFunc for V.
+type GAEJudger struct {
+	Discount  float64
+	Lambda    float64
+	ValueFunc ValueFunc
+}
+
+// JudgeActions implements anypg.ActionJudger.
+func (g *GAEJudger) JudgeActions(r *anyrl.RolloutSet) anyrl.Rewards {
+	obsSeqs := readTapeSequences(r.Inputs)
+	var out anyrl.Rewards
+	for i, ep := range r.Rewards {
+		values := g.ValueFunc.Values(obsSeqs[i])
+		advantages := make([]float64, len(ep))
+		var acc float64
+		for t := len(ep) - 1; t >= 0; t-- {
+			var nextValue float64
+			if t+1 < len(values) {
+				nextValue = values[t+1]
+			}
+			delta := ep[t] + g.Discount*nextValue - values[t]
+			acc = delta + g.Discount*g.Lambda*acc
+			advantages[t] = acc
+		}
+		out = append(out, advantages)
+	}
+	return out
+}
+
+// A VTraceJudger computes off-policy-corrected value targets
+// so that stale or imagined rollouts (e.g. from distributed
+// workers or the ImaginedRoller) can be reused across several
+// TRPO updates without the usual on-policy assumption. It
+// clips importance ratios rho_t = min(rhoBar, pi(a|s)/mu(a|s))
+// and c_t = min(cBar, rho_t), producing
+//
+//	v_s = V(s) + sum_{t>=s} gamma^(t-s) * (prod_{i=s}^{t-1} c_i) * rho_t * delta_t
+type VTraceJudger struct {
+	Discount  float64
+	ValueFunc ValueFunc
+
+	// Policy is used to recompute the current policy's
+	// action probabilities; AgentOuts on the RolloutSet holds
+	// the behavior policy's probabilities as recorded at
+	// collection time.
+	Policy      anyrnn.Block
+	ActionSpace anyrl.Softmax
+}
+
+// JudgeActions implements anypg.ActionJudger.
+func (j *VTraceJudger) JudgeActions(r *anyrl.RolloutSet) anyrl.Rewards {
+	obsSeqs := readTapeSequences(r.Inputs)
+	muSeqs := readTapeSequences(r.AgentOuts)
+	actionSeqs := readTapeSequences(r.Actions)
+
+	var out anyrl.Rewards
+	for i, ep := range r.Rewards {
+		values := j.ValueFunc.Values(obsSeqs[i])
+		pis := currentLogProbs(j.Policy, obsSeqs[i])
+
+		n := len(ep)
+		deltas := make([]float64, n)
+		rhos := make([]float64, n)
+		cs := make([]float64, n)
+		for t := 0; t < n; t++ {
+			muP := actionLogProb(muSeqs[i][t], actionSeqs[i][t])
+			piP := actionLogProb(pis[t], actionSeqs[i][t])
+			ratio := math.Exp(piP - muP)
+			rho := math.Min(VTraceRhoClip, ratio)
+			rhos[t] = rho
+			cs[t] = math.Min(VTraceCClip, rho)
+
+			var nextValue float64
+			if t+1 < n {
+				nextValue = values[t+1]
+			}
+			deltas[t] = rho * (ep[t] + j.Discount*nextValue - values[t])
+		}
+
+		targets := make([]float64, n)
+		var acc float64
+		for t := n - 1; t >= 0; t-- {
+			acc = deltas[t] + j.Discount*cs[t]*acc
+			targets[t] = values[t] + acc
+		}
+		out = append(out, targets)
+	}
+	return out
+}
+
+// currentLogProbs re-runs obs through the current policy to
+// get up-to-date action distributions, needed because the
+// rollout's stored AgentOuts reflect the (possibly stale)
+// behavior policy instead.
+func currentLogProbs(policy anyrnn.Block, obs []anyvec.Vector) []anyvec.Vector {
+	state := policy.Start(1)
+	out := make([]anyvec.Vector, len(obs))
+	for i, o := range obs {
+		res := policy.Step(state, o)
+		state = res.State()
+		out[i] = res.Output()
+	}
+	return out
+}
+
+// actionLogProb reads the log-probability of the one-hot
+// action from a vector of softmax logits.
+func actionLogProb(logits, action anyvec.Vector) float64 {
+	logProbs := anynet.LogSoftmax.Apply(anydiff.NewConst(logits), 1).Output().Data().([]float32)
+	actionData := action.Data().([]float32)
+	for i, a := range actionData {
+		if a != 0 {
+			return float64(logProbs[i])
+		}
+	}
+	return math.Inf(-1)
+}
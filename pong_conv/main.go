@@ -2,6 +2,7 @@ package main
 
 import (
 	"compress/flate"
+	"fmt"
 	"log"
 	"math"
 	"sync"
@@ -38,39 +39,105 @@ func main() {
 	// Setup vector creator.
 	creator := anyvec32.CurrentCreator()
 
-	// Create multiple environment instances so that we
-	// can record multiple episodes at once.
-	log.Println("Creating environments...")
-	var envs []anyrl.Env
-	for i := 0; i < ParallelEnvs; i++ {
-		// Connect to gym server.
-		client, err := gym.Make(Host, "Pong-v0")
-		must(err)
-
-		defer client.Close()
-
-		// Create an anyrl.Env from our gym environment.
-		env, err := anyrl.GymEnv(creator, client, RenderEnv)
-		must(err)
-
-		envs = append(envs, &PreprocessEnv{Env: env})
+	// A worker process never trains anything itself: it just
+	// dials the coordinator, runs Pong-v0 instances, and
+	// streams rollouts back.
+	if RunAsWorker() {
+		runWorker(creator)
+		return
 	}
 
 	// Create a neural network policy.
 	policy := loadOrCreateNetwork(creator)
 	actionSpace := anyrl.Softmax{}
 
-	// Setup an RNNRoller for producing rollouts.
-	roller := &anyrl.RNNRoller{
-		Block:       policy,
-		ActionSpace: actionSpace,
+	// trainLock guards policy's parameter vectors. It is
+	// taken whenever they are updated (grad.AddToVars below)
+	// or saved, and the coordinator also takes it before
+	// reading them for a PullParams reply, so a worker never
+	// observes a torn mid-update policy.
+	var trainLock sync.Mutex
 
-		// Compress the input frames as we store them.
-		// If we used a ReferenceTape for the input, the
-		// program would use way too much memory.
-		MakeInputTape: func() (lazyseq.Tape, chan<- *anyseq.Batch) {
-			return lazyseq.CompressedUint8Tape(flate.DefaultCompression)
-		},
+	// Gather rollouts either in-process (the original
+	// behavior) or from distributed RolloutWorkers connecting
+	// over TCP, letting a single TRPO trainer scale across
+	// many machines without touching the learning code below.
+	var worker *RolloutWorker
+	var collected chan *anyrl.RolloutSet
+	if UseDistributedWorkers {
+		collected = make(chan *anyrl.RolloutSet, ParallelEnvs)
+		must(RunCoordinator(CoordinatorHost, creator, &policy, &trainLock, collected))
+	} else {
+		log.Println("Creating environments...")
+		var envs []anyrl.Env
+		for i := 0; i < ParallelEnvs; i++ {
+			// Connect to gym server.
+			client, err := gym.Make(Host, "Pong-v0")
+			must(err)
+
+			defer client.Close()
+
+			// Create an anyrl.Env from our gym environment.
+			env, err := anyrl.GymEnv(client, RenderEnv)
+			must(err)
+
+			envs = append(envs, &PreprocessEnv{Env: env})
+		}
+
+		worker = NewLocalWorker(envs, &anyrl.RNNRoller{
+			Block:         policy,
+			ActionSpace:   actionSpace,
+			MakeInputTape: makeInputTape,
+		})
+	}
+
+	// Optionally train a forward dynamics model alongside the
+	// policy so that TRPO can be run on a mix of real and
+	// imagined rollouts, cutting down on environment interaction.
+	var dynamics *DynamicsModel
+	var dynamicsTrainer *DynamicsTrainer
+	var imaginedRoller *ImaginedRoller
+	if UseDynamicsModel {
+		dynamics = NewDynamicsModel(creator)
+		if err := serializer.LoadAny(DynamicsSaveFile, &dynamics); err == nil {
+			log.Println("Loaded dynamics model from file.")
+		}
+		dynamicsTrainer = NewDynamicsTrainer(dynamics)
+		imaginedRoller = &ImaginedRoller{
+			Policy:      policy,
+			ActionSpace: actionSpace,
+			Model:       dynamics,
+		}
+	}
+
+	// Pick an ActionJudger. GAE and V-trace both need a value
+	// function, so they share a ValueNet with its own head but
+	// the policy's conv+RNN body, trained jointly below.
+	var valueNet *ValueNet
+	var valueTrainer *ValueTrainer
+	var actionJudger anypg.ActionJudger
+	switch ActionJudgerKind() {
+	case "gae":
+		valueNet = NewValueNet(creator, policy[:len(policy)-1])
+		if err := serializer.LoadAny(ValueNetSaveFile, &valueNet.Head); err == nil {
+			log.Println("Loaded value head from file.")
+		}
+		valueTrainer = NewValueTrainer(valueNet)
+		actionJudger = &GAEJudger{Discount: GAEDiscount, Lambda: GAELambda, ValueFunc: valueNet}
+	case "vtrace":
+		valueNet = NewValueNet(creator, policy[:len(policy)-1])
+		if err := serializer.LoadAny(ValueNetSaveFile, &valueNet.Head); err == nil {
+			log.Println("Loaded value head from file.")
+		}
+		valueTrainer = NewValueTrainer(valueNet)
+		actionJudger = &VTraceJudger{
+			Discount:    GAEDiscount,
+			ValueFunc:   valueNet,
+			Policy:      policy,
+			ActionSpace: actionSpace,
+		}
+	default:
+		actionJudger = &anypg.QJudger{Discount: 0.99}
 	}
 
 	// Setup Trust Region Policy Optimization for training.
@@ -84,21 +151,40 @@ func main() {
 			Iters: 10,
 			Reduce: (&anyrl.FracReducer{
 				Frac:          0.1,
-				MakeInputTape: roller.MakeInputTape,
+				MakeInputTape: makeInputTape,
 			}).Reduce,
 
 			ApplyPolicy: func(seq lazyseq.Rereader, b anyrnn.Block) lazyseq.Rereader {
 				out := lazyrnn.FixedHSM(30, false, seq, b)
 				return lazyseq.Lazify(lazyseq.Unlazify(out))
 			},
-			ActionJudger: &anypg.QJudger{Discount: 0.99},
+			ActionJudger: actionJudger,
 		},
 	}
 
+	// Optionally stop training early once an EarlyStopper,
+	// fed by periodic deterministic validation rollouts,
+	// decides the policy has stopped improving.
+	var stopper EarlyStopper
+	var plateauStopper *PlateauStopper
+	if UseEarlyStopping {
+		switch EarlyStopperKind() {
+		case "target":
+			stopper = &TargetStopper{Target: TargetReward}
+		case "plateau":
+			plateauStopper = &PlateauStopper{Threshold: PlateauThreshold, Patience: PlateauPatience}
+			stopper = plateauStopper
+		default:
+			stopper = &PatienceStopper{Patience: 20}
+		}
+	}
+	var bestMean = math.Inf(-1)
+	stopped := make(chan struct{})
+
 	// Train on a background goroutine so that we can
 	// listen for Ctrl+C on the main goroutine.
-	var trainLock sync.Mutex
 	go func() {
+		defer close(stopped)
 		for batchIdx := 0; true; batchIdx++ {
 			log.Println("Gathering batch of experience...")
 
@@ -106,8 +192,14 @@ func main() {
 			var rollouts []*anyrl.RolloutSet
 			var steps int
 			for steps < BatchSteps {
-				rollout, err := roller.Rollout(envs...)
-				must(err)
+				var rollout *anyrl.RolloutSet
+				if UseDistributedWorkers {
+					rollout = <-collected
+				} else {
+					var err error
+					rollout, err = worker.Rollout()
+					must(err)
+				}
 				steps += rollout.NumSteps()
 				log.Printf("batch %d: steps=%d sub_mean=%f", batchIdx, steps,
 					rollout.Rewards.Mean())
@@ -115,33 +207,107 @@ func main() {
 			}
 
 			// Join the rollouts into one set.
-			r := anyrl.PackRolloutSets(rollouts)
+			r := anyrl.PackRolloutSets(creator, rollouts)
 
 			// Print the stats for the batch.
 			log.Printf("batch %d: mean=%f stddev=%f", batchIdx,
 				r.Rewards.Mean(), math.Sqrt(r.Rewards.Variance()))
 
+			if UseDynamicsModel {
+				log.Println("Training dynamics model...")
+				dynamicsTrainer.Train(r)
+				for _, t := range extractTransitions(r) {
+					imaginedRoller.AddStart(t.Obs, t.Action, t.NextObs)
+				}
+
+				imagined := imaginedRoller.Rollout(int(float64(len(rollouts)) * ImaginedFrac))
+				if imagined != nil {
+					log.Printf("batch %d: imagined_mean=%f", batchIdx, imagined.Rewards.Mean())
+					r = anyrl.PackRolloutSets(creator, []*anyrl.RolloutSet{r, imagined})
+				}
+			}
+
+			if valueTrainer != nil {
+				log.Println("Training value net...")
+				valueTrainer.Train(r)
+			}
+
 			// Train on the rollouts.
 			log.Println("Training on batch...")
 			grad := trpo.Run(r)
-			trainLock.Lock()
-			if PrintNorms {
-				for i, param := range anynet.AllParameters(policy) {
-					log.Println("param", i, "mag", anyvec.Norm(grad[param]))
+
+			// trainLock stays held through the validation and
+			// best-checkpoint block below, not just AddToVars:
+			// bestMean and BestPolicySaveFile are read back by
+			// the shutdown path under the same lock, and without
+			// this they could be read mid-write if Ctrl+C lands
+			// while a validation round is in flight.
+			stop := func() bool {
+				trainLock.Lock()
+				defer trainLock.Unlock()
+
+				if PrintNorms {
+					for i, param := range anynet.AllParameters(policy) {
+						log.Println("param", i, "mag", anyvec.Norm(grad[param]))
+					}
+				}
+				if plateauStopper != nil {
+					var stepNorm float64
+					for _, param := range anynet.AllParameters(policy) {
+						n := anyvec.Norm(grad[param]).(float64)
+						stepNorm += n * n
+					}
+					plateauStopper.StepSize = math.Sqrt(stepNorm)
 				}
+				grad.AddToVars()
+
+				if UseEarlyStopping && worker != nil && batchIdx%ValidationInterval == 0 {
+					log.Println("Running validation rollouts...")
+					mean, stddev := runValidation(worker.Roller, worker.Envs, ValidationEpisodes)
+					log.Printf("batch %d: validation_mean=%f validation_stddev=%f", batchIdx, mean, stddev)
+
+					if mean > bestMean {
+						bestMean = mean
+						must(serializer.SaveAny(BestPolicySaveFile, policy))
+					}
+
+					if stopper.Observe(batchIdx, mean, stddev) {
+						log.Println("Early stopping:", stopper.Reason())
+						return true
+					}
+				}
+				return false
+			}()
+			if stop {
+				return
 			}
-			grad.AddToVars()
-			trainLock.Unlock()
 		}
 	}()
 
 	log.Println("Running. Press Ctrl+C to stop.")
-	<-rip.NewRIP().Chan()
+	select {
+	case <-rip.NewRIP().Chan():
+	case <-stopped:
+	}
 
 	// Avoid the race condition where we save during
 	// parameter updates.
 	trainLock.Lock()
-	must(serializer.SaveAny(NetworkSaveFile, policy))
+	if UseEarlyStopping && bestMean > math.Inf(-1) {
+		// Prefer the best-checkpointed policy over the last
+		// one, since the last batch may have been worse.
+		var best anyrnn.Stack
+		must(serializer.LoadAny(BestPolicySaveFile, &best))
+		must(serializer.SaveAny(NetworkSaveFile, best))
+	} else {
+		must(serializer.SaveAny(NetworkSaveFile, policy))
+	}
+	if UseDynamicsModel {
+		must(serializer.SaveAny(DynamicsSaveFile, dynamics))
+	}
+	if valueNet != nil {
+		must(serializer.SaveAny(ValueNetSaveFile, valueNet.Head))
+	}
 }
 
 func loadOrCreateNetwork(creator anyvec.Creator) anyrnn.Stack {
@@ -151,18 +317,18 @@ func loadOrCreateNetwork(creator anyvec.Creator) anyrnn.Stack {
 		return res
 	} else {
 		log.Println("Created new network.")
-		markup := `
+		markup := fmt.Sprintf(`
 			Input(w=80, h=105, d=2)
 
-			Linear(scale=0.01)
+			Linear(scale=%f)
 
 			Conv(w=4, h=4, n=16, sx=2, sy=2)
-			Tanh
+			%s
 			Conv(w=4, h=4, n=32, sx=2, sy=2)
-			Tanh
+			%s
 			FC(out=128)
-			Tanh
-		`
+			%s
+		`, linearScale(), activationMarkup(), activationMarkup(), activationMarkup())
 		convNet, err := anyconv.FromMarkup(creator, markup)
 		must(err)
 		net := convNet.(anynet.Net)
@@ -170,7 +336,7 @@ func loadOrCreateNetwork(creator anyvec.Creator) anyrnn.Stack {
 		return anyrnn.Stack{
 			NewStacker(creator, 1, PreprocessedSize),
 			&anyrnn.LayerBlock{Layer: net},
-			anyrnn.NewVanilla(creator, 128, 128, anynet.Tanh),
+			anyrnn.NewVanilla(creator, 128, 128, vanillaActivation()),
 			&anyrnn.LayerBlock{
 				Layer: anynet.NewFCZero(creator, 128, 6),
 			},
@@ -181,7 +347,9 @@ func loadOrCreateNetwork(creator anyvec.Creator) anyrnn.Stack {
 func setupVisionLayers(net anynet.Net) anynet.Net {
 	for _, layer := range net {
 		projectOutSolidColors(layer)
-		//boostBiases(layer)
+		if useBiasBoost() {
+			boostBiases(layer)
+		}
 	}
 	return net
 }
@@ -230,6 +398,13 @@ func setupVanilla(v *anyrnn.Vanilla) *anyrnn.Vanilla {
 	return v
 }
 
+// makeInputTape compresses input frames as they are stored.
+// If we used a ReferenceTape for the input, the program
+// would use way too much memory.
+func makeInputTape(c anyvec.Creator) (lazyseq.Tape, chan<- *anyseq.Batch) {
+	return lazyseq.CompressedUint8Tape(c, flate.DefaultCompression)
+}
+
 func must(err error) {
 	if err != nil {
 		panic(err)
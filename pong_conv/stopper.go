@@ -0,0 +1,186 @@
+package main
+
+import (
+	"math"
+	"os"
+
+	"github.com/unixpickle/anyrl"
+	"github.com/unixpickle/anyvec"
+)
+
+const (
+	// UseEarlyStopping enables the EarlyStopper subsystem and
+	// the validation rollouts that feed it. With it off,
+	// training runs forever until Ctrl+C, as before.
+	UseEarlyStopping = false
+
+	// ValidationInterval is how many training batches pass
+	// between rounds of deterministic validation rollouts.
+	ValidationInterval = 10
+
+	// ValidationEpisodes is how many greedy rollouts are run
+	// each validation round.
+	ValidationEpisodes = 4
+
+	// BestPolicySaveFile is where the best-so-far policy, as
+	// judged by the EarlyStopper's validation rollouts, is
+	// checkpointed.
+	BestPolicySaveFile = "trained_policy_best"
+
+	// TargetReward is the validation mean TargetStopper waits
+	// for: Pong-v0's maximum possible score.
+	TargetReward = 21
+
+	// PlateauThreshold and PlateauPatience configure
+	// PlateauStopper: it stops once the TRPO step size has
+	// stayed below PlateauThreshold for PlateauPatience
+	// consecutive validation rounds.
+	PlateauThreshold = 0.001
+	PlateauPatience  = 20
+)
+
+// EarlyStopperKind selects which EarlyStopper main uses when
+// UseEarlyStopping is set, overridable with the EARLY_STOPPER
+// environment variable ("patience", "target", or "plateau").
+// It defaults to PatienceStopper, matching the behavior this
+// subsystem shipped with before TargetStopper and
+// PlateauStopper existed.
+func EarlyStopperKind() string {
+	switch os.Getenv("EARLY_STOPPER") {
+	case "target":
+		return "target"
+	case "plateau":
+		return "plateau"
+	default:
+		return "patience"
+	}
+}
+
+// An EarlyStopper watches the mean and standard deviation of
+// validation rollouts across training batches and decides
+// when training should stop.
+type EarlyStopper interface {
+	// Observe reports the result of one round of validation
+	// rollouts and returns true once training should stop.
+	Observe(batchIdx int, meanReward, stddev float64) bool
+
+	// Reason explains why Observe last returned true.
+	Reason() string
+}
+
+// A PatienceStopper halts training after Patience
+// consecutive Observe calls (validation rounds) bring no
+// improvement over the best validation mean seen so far.
+// Each round's mean is compared as is; no moving average is
+// taken.
+type PatienceStopper struct {
+	Patience int
+
+	best        float64
+	sinceImprov int
+	started     bool
+}
+
+// Observe implements EarlyStopper.
+func (p *PatienceStopper) Observe(batchIdx int, meanReward, stddev float64) bool {
+	if !p.started || meanReward > p.best {
+		p.best = meanReward
+		p.sinceImprov = 0
+		p.started = true
+		return false
+	}
+	p.sinceImprov++
+	return p.sinceImprov >= p.Patience
+}
+
+// Reason implements EarlyStopper.
+func (p *PatienceStopper) Reason() string {
+	return "no improvement in validation mean reward"
+}
+
+// A TargetStopper halts training as soon as a validation
+// round's mean reward reaches Target.
+type TargetStopper struct {
+	Target float64
+}
+
+// Observe implements EarlyStopper.
+func (t *TargetStopper) Observe(batchIdx int, meanReward, stddev float64) bool {
+	return meanReward >= t.Target
+}
+
+// Reason implements EarlyStopper.
+func (t *TargetStopper) Reason() string {
+	return "reached target reward"
+}
+
+// A PlateauStopper halts training once the TRPO step size
+// has stayed below Threshold for Patience consecutive Observe
+// calls (validation rounds), indicating the policy has stopped
+// moving. The step size is the L2 norm of TRPO's parameter
+// step, not a KL divergence, and only the step taken just
+// before each Observe call is looked at.
+type PlateauStopper struct {
+	Threshold float64
+	Patience  int
+
+	// StepSize is set by main() before each Observe call to
+	// report the most recent TRPO step size.
+	StepSize float64
+
+	belowCount int
+}
+
+// Observe implements EarlyStopper.
+func (p *PlateauStopper) Observe(batchIdx int, meanReward, stddev float64) bool {
+	if p.StepSize < p.Threshold {
+		p.belowCount++
+	} else {
+		p.belowCount = 0
+	}
+	return p.belowCount >= p.Patience
+}
+
+// Reason implements EarlyStopper.
+func (p *PlateauStopper) Reason() string {
+	return "TRPO step size plateaued"
+}
+
+// greedySoftmax picks the highest-probability action instead
+// of sampling from the softmax distribution, so validation
+// rollouts are deterministic.
+type greedySoftmax struct {
+	anyrl.Softmax
+}
+
+// Sample implements anyrl.Sampler by returning the argmax
+// action for each row of params, rather than sampling it.
+func (g greedySoftmax) Sample(params anyvec.Vector, numSamples int) anyvec.Vector {
+	out := make([]float64, params.Len())
+	rowSize := params.Len() / numSamples
+	for i := 0; i < numSamples; i++ {
+		row := params.Slice(i*rowSize, (i+1)*rowSize)
+		best := anyvec.MaxIndex(row)
+		out[i*rowSize+best] = 1
+	}
+	c := params.Creator()
+	return c.MakeVectorData(c.MakeNumericList(out))
+}
+
+// runValidation performs n deterministic (greedy argmax
+// action) rollouts against envs and returns their mean and
+// standard deviation reward, without feeding anything to the
+// training gradient.
+func runValidation(roller *anyrl.RNNRoller, envs []anyrl.Env, n int) (mean, stddev float64) {
+	greedy := *roller
+	greedy.ActionSpace = greedySoftmax{}
+
+	var rollouts []*anyrl.RolloutSet
+	for i := 0; i < n; i++ {
+		rollout, err := greedy.Rollout(envs...)
+		must(err)
+		rollouts = append(rollouts, rollout)
+	}
+	r := anyrl.PackRolloutSets(rollouts[0].Creator(), rollouts)
+	return r.Rewards.Mean(), math.Sqrt(r.Rewards.Variance())
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyrl"
+	"github.com/unixpickle/anyvec"
+	gym "github.com/unixpickle/gym-socket-api/binding-go"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/serializer"
+)
+
+const (
+	// UseDistributedWorkers switches the rollout-gathering
+	// half of main from running ParallelEnvs locally to
+	// connecting to a coordinator over TCP and pulling work
+	// from there instead.
+	UseDistributedWorkers = false
+
+	// CoordinatorHost is where workers dial in, and where the
+	// coordinator listens when UseDistributedWorkers is set.
+	CoordinatorHost = "localhost:5002"
+
+	// HeartbeatInterval is the least time between two
+	// heartbeats; a worker sends one after a rollout once this
+	// much time has passed since the last.
+	HeartbeatInterval = 10 * time.Second
+)
+
+// RunAsWorker reports whether this process should act purely
+// as a remote RolloutWorker, set with the WORKER=1
+// environment variable. A worker process dials
+// CoordinatorHost, pulls the latest policy before every
+// batch, runs its own Pong-v0 instances, and streams completed
+// rollouts back instead of training anything itself.
+func RunAsWorker() bool {
+	return os.Getenv("WORKER") == "1"
+}
+
+// runWorker is main's entry point when RunAsWorker is set. It
+// runs until the connection to the coordinator fails.
+func runWorker(creator anyvec.Creator) {
+	worker, err := DialWorker(CoordinatorHost, creator)
+	must(err)
+
+	var policy anyrnn.Stack
+	lastHeartbeat := time.Now()
+	for {
+		must(worker.PullParams(&policy))
+		worker.Roller.Block = policy
+
+		if _, err := worker.Rollout(); err != nil {
+			log.Println("worker: rollout failed:", err)
+			return
+		}
+
+		if time.Since(lastHeartbeat) >= HeartbeatInterval {
+			must(worker.Heartbeat())
+			lastHeartbeat = time.Now()
+		}
+	}
+}
+
+// Message types for the framed worker protocol. Every frame
+// on the wire is a 4-byte big-endian length prefix, a
+// 1-byte message type, and a gob-encoded body.
+type msgType byte
+
+const (
+	msgPullParams msgType = iota
+	msgParams
+	msgPushRollout
+	msgHeartbeat
+)
+
+// pullParamsMsg asks the coordinator for the latest policy.
+type pullParamsMsg struct{}
+
+// paramsMsg is the coordinator's reply to a PullParams
+// request: the anyrnn.Stack as serialized by
+// serializer.SerializeWithType.
+type paramsMsg struct {
+	Policy []byte
+}
+
+// pushRolloutMsg is a worker's report of one batch of
+// experience. Inputs, AgentOuts, and Actions hold the
+// corresponding RolloutSet tapes, flate-compressed by
+// encodeTape.
+type pushRolloutMsg struct {
+	Rewards   [][]float64
+	Inputs    []byte
+	AgentOuts []byte
+	Actions   []byte
+}
+
+// heartbeatMsg keeps idle connections alive.
+type heartbeatMsg struct{}
+
+// writeFrame writes a length-prefixed, type-tagged, gob
+// encoded message to w.
+func writeFrame(w io.Writer, t msgType, v interface{}) error {
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(v); err != nil {
+		return err
+	}
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(body.Len()+1))
+	header[4] = byte(t)
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(body.Bytes())
+	return err
+}
+
+// readFrame reads one length-prefixed message from r and
+// decodes its body into v, returning the message's type.
+func readFrame(r io.Reader, v interface{}) (msgType, error) {
+	var lenPrefix [4]byte
+	if _, err := io.ReadFull(r, lenPrefix[:]); err != nil {
+		return 0, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(lenPrefix[:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, err
+	}
+	t := msgType(body[0])
+	if v != nil {
+		if err := gob.NewDecoder(bytes.NewReader(body[1:])).Decode(v); err != nil {
+			return t, err
+		}
+	}
+	return t, nil
+}
+
+// tapePayload is the wire format for a lazyseq.Tape: one
+// float32 slice per (sequence, timestep). decodeTape regroups
+// them into one batch per timestep.
+type tapePayload struct {
+	Seqs [][][]float32
+}
+
+// encodeTape flattens tape into a tapePayload and flate-
+// compresses it, the same flate.DefaultCompression scheme (and
+// level) makeInputTape already uses via CompressedUint8Tape for
+// on-disk storage. CompressedUint8Tape's own byte-per-component
+// packing only applies to Inputs, whose pixels are already in
+// [0, 255]; Actions and AgentOuts hold signed, fractional
+// values (one-hot floats and raw logits), so this keeps their
+// full float32 precision and compresses the binary encoding
+// directly instead.
+func encodeTape(tape lazyseq.Tape) []byte {
+	var payload tapePayload
+	for _, seq := range readTapeSequences(tape) {
+		var raw [][]float32
+		for _, v := range seq {
+			raw = append(raw, v.Data().([]float32))
+		}
+		payload.Seqs = append(payload.Seqs, raw)
+	}
+
+	var raw bytes.Buffer
+	must(gob.NewEncoder(&raw).Encode(payload))
+
+	var compressed bytes.Buffer
+	w, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+	must(err)
+	_, err = w.Write(raw.Bytes())
+	must(err)
+	must(w.Close())
+	return compressed.Bytes()
+}
+
+// decodeTape reconstructs a lazyseq.Tape from bytes produced
+// by encodeTape.
+func decodeTape(creator anyvec.Creator, data []byte) lazyseq.Tape {
+	var raw bytes.Buffer
+	r := flate.NewReader(bytes.NewReader(data))
+	_, err := io.Copy(&raw, r)
+	must(err)
+	must(r.Close())
+
+	var payload tapePayload
+	must(gob.NewDecoder(&raw).Decode(&payload))
+
+	tape, ch := lazyseq.ReferenceTape(creator)
+	maxLen := 0
+	for _, seq := range payload.Seqs {
+		if len(seq) > maxLen {
+			maxLen = len(seq)
+		}
+	}
+	for t := 0; t < maxLen; t++ {
+		present := make([]bool, len(payload.Seqs))
+		var packed []float32
+		for i, seq := range payload.Seqs {
+			if t >= len(seq) {
+				continue
+			}
+			present[i] = true
+			packed = append(packed, seq[t]...)
+		}
+		vec := creator.MakeVectorData(packed)
+		ch <- &anyseq.Batch{Present: present, Packed: vec}
+	}
+	close(ch)
+	return tape
+}
+
+// A RolloutWorker gathers PreprocessEnv rollouts against
+// ParallelEnvs Pong-v0 instances and, depending on how it is
+// constructed, either hands them straight to an in-process
+// caller or streams them to a remote coordinator. This lets
+// a single TRPO trainer scale across many machines without
+// changing any of the learning code.
+type RolloutWorker struct {
+	Envs   []anyrl.Env
+	Roller *anyrl.RNNRoller
+
+	// Conn is nil for an in-process worker. When set, Rollout
+	// pushes its result to the coordinator instead of
+	// returning it, and PullParams fetches the latest policy
+	// from the coordinator before each batch.
+	Conn    net.Conn
+	Creator anyvec.Creator
+}
+
+// NewLocalWorker builds a RolloutWorker that runs entirely
+// in-process, matching main()'s original behavior.
+func NewLocalWorker(envs []anyrl.Env, roller *anyrl.RNNRoller) *RolloutWorker {
+	return &RolloutWorker{Envs: envs, Roller: roller}
+}
+
+// DialWorker connects to a coordinator at host and returns a
+// RolloutWorker that pulls policy parameters from it and
+// streams rollouts back, running its own Pong-v0 instances
+// locally against the gym-socket-api server at Host.
+func DialWorker(host string, creator anyvec.Creator) (*RolloutWorker, error) {
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	var envs []anyrl.Env
+	for i := 0; i < ParallelEnvs; i++ {
+		client, err := gym.Make(Host, "Pong-v0")
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		env, err := anyrl.GymEnv(client, RenderEnv)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		envs = append(envs, &PreprocessEnv{Env: env})
+	}
+
+	return &RolloutWorker{
+		Envs: envs,
+		Roller: &anyrl.RNNRoller{
+			ActionSpace:   anyrl.Softmax{},
+			MakeInputTape: makeInputTape,
+		},
+		Conn:    conn,
+		Creator: creator,
+	}, nil
+}
+
+// PullParams fetches the coordinator's current policy and
+// installs it into *policy. It is a no-op for in-process
+// workers, since they already share the coordinator's policy
+// object.
+func (w *RolloutWorker) PullParams(policy *anyrnn.Stack) error {
+	if w.Conn == nil {
+		return nil
+	}
+	if err := writeFrame(w.Conn, msgPullParams, pullParamsMsg{}); err != nil {
+		return err
+	}
+	var reply paramsMsg
+	if _, err := readFrame(w.Conn, &reply); err != nil {
+		return err
+	}
+	obj, err := serializer.DeserializeWithType(reply.Policy)
+	if err != nil {
+		return err
+	}
+	stack, ok := obj.(anyrnn.Stack)
+	if !ok {
+		return fmt.Errorf("pull params: unexpected policy type %T", obj)
+	}
+	*policy = stack
+	return nil
+}
+
+// Rollout gathers one batch of experience. For an in-process
+// worker it is returned directly; for a remote worker it is
+// streamed to the coordinator and Rollout returns nil.
+func (w *RolloutWorker) Rollout() (*anyrl.RolloutSet, error) {
+	rollout, err := w.Roller.Rollout(w.Envs...)
+	if err != nil {
+		return nil, err
+	}
+	if w.Conn == nil {
+		return rollout, nil
+	}
+	return nil, w.pushRollout(rollout)
+}
+
+func (w *RolloutWorker) pushRollout(r *anyrl.RolloutSet) error {
+	return writeFrame(w.Conn, msgPushRollout, pushRolloutMsg{
+		Rewards:   r.Rewards,
+		Inputs:    encodeTape(r.Inputs),
+		AgentOuts: encodeTape(r.AgentOuts),
+		Actions:   encodeTape(r.Actions),
+	})
+}
+
+// Heartbeat pings the coordinator so a dead connection is
+// noticed instead of silently blocking a future PullParams.
+func (w *RolloutWorker) Heartbeat() error {
+	if w.Conn == nil {
+		return nil
+	}
+	return writeFrame(w.Conn, msgHeartbeat, heartbeatMsg{})
+}
+
+// RunCoordinator listens on host and serves PullParams,
+// PushRollout, and Heartbeat requests from remote
+// RolloutWorkers, handing completed rollouts to collected as
+// they arrive. The TRPO trainer in main() drains collected
+// itself; RunCoordinator never blocks on it. lock is the same
+// mutex main() holds while applying gradients to policy, so a
+// PullParams reply never reads a torn mid-update policy.
+func RunCoordinator(host string, creator anyvec.Creator, policy *anyrnn.Stack,
+	lock *sync.Mutex, collected chan<- *anyrl.RolloutSet) error {
+	ln, err := net.Listen("tcp", host)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Println("coordinator: accept failed:", err)
+				continue
+			}
+			go serveWorker(conn, creator, policy, lock, collected)
+		}
+	}()
+	return nil
+}
+
+func serveWorker(conn net.Conn, creator anyvec.Creator, policy *anyrnn.Stack,
+	lock *sync.Mutex, collected chan<- *anyrl.RolloutSet) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var push pushRolloutMsg
+		t, err := readFrame(r, &push)
+		if err != nil {
+			return
+		}
+		switch t {
+		case msgPullParams:
+			lock.Lock()
+			data, err := serializer.SerializeWithType(*policy)
+			lock.Unlock()
+			if err != nil {
+				log.Println("coordinator: serialize failed:", err)
+				return
+			}
+			if err := writeFrame(conn, msgParams, paramsMsg{Policy: data}); err != nil {
+				return
+			}
+		case msgPushRollout:
+			collected <- &anyrl.RolloutSet{
+				Rewards:   push.Rewards,
+				Inputs:    decodeTape(creator, push.Inputs),
+				AgentOuts: decodeTape(creator, push.AgentOuts),
+				Actions:   decodeTape(creator, push.Actions),
+			}
+		case msgHeartbeat:
+		}
+	}
+}